@@ -4,12 +4,109 @@ import (
 	"context"
 	"time"
 
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
 	"github.com/filecoin-project/lotus/chain/types"
 )
 
-// WrapHeadChangeCoalescer wraps a ReorgNotifee with a head change coalescer.
+// CoalescerNameKey tags coalescer metrics with the CoalescerConfig.Name of
+// the instance that produced them, so an operator with several named
+// coalescers (e.g. one per MultiNotifee subscriber) can tell which one is
+// dropping events, getting forced dispatches, or running slow.
+var CoalescerNameKey, _ = tag.NewKey("coalescer_name")
+
+// Measures for HeadChangeCoalescer, following the rest of the codebase's
+// go.opencensus.io/stats convention rather than a second, independent
+// metrics registry: the binary wires these up alongside its other views via
+// view.Register(store.Views...), same as every other package's measures.
+var (
+	CoalescedTotal      = stats.Int64("chain/coalescer_coalesced_total", "Number of head change notifications merged into a pending coalesced dispatch.", stats.UnitDimensionless)
+	DroppedEventsTotal  = stats.Int64("chain/coalescer_dropped_events_total", "Number of queued (not yet coalesced) head change events dropped because the event buffer was full.", stats.UnitDimensionless)
+	ForcedDispatchTotal = stats.Int64("chain/coalescer_forced_dispatch_total", "Number of dispatches forced by MaxDelay or MaxPendingTipsets rather than the idle MinDelay timer.", stats.UnitDimensionless)
+	DispatchLatency     = stats.Float64("chain/coalescer_dispatch_latency_seconds", "Time spent in the wrapped ReorgNotifee during a coalesced dispatch.", stats.UnitSeconds)
+)
+
+// Views are this package's opencensus views, tagged by CoalescerNameKey. The
+// binary registers them (view.Register(store.Views...)) alongside the rest
+// of its views; chain/store does not register them itself, so importing it
+// more than once into a process cannot panic the way prometheus.MustRegister
+// would on a duplicate registration.
+var Views = []*view.View{
+	{
+		Measure:     CoalescedTotal,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{CoalescerNameKey},
+	},
+	{
+		Measure:     DroppedEventsTotal,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{CoalescerNameKey},
+	},
+	{
+		Measure:     ForcedDispatchTotal,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{CoalescerNameKey},
+	},
+	{
+		Measure:     DispatchLatency,
+		Aggregation: view.Distribution(0, .05, .1, .25, .5, 1, 2.5, 5, 10, 30),
+		TagKeys:     []tag.Key{CoalescerNameKey},
+	},
+}
+
+// CoalescerConfig bounds the latency and memory behaviour of a
+// HeadChangeCoalescer.
+type CoalescerConfig struct {
+	// MinDelay is the quiet period after the most recent head change before
+	// a coalesced dispatch fires; every new head change resets it, so a
+	// steady trickle of events can keep postponing dispatch.
+	MinDelay time.Duration
+	// MaxDelay is a hard upper bound, measured from the first pending head
+	// change, after which dispatch fires regardless of MinDelay or further
+	// incoming events. This is what keeps a sustained stream of head
+	// changes from starving a notifee indefinitely.
+	MaxDelay time.Duration
+	// MaxPendingTipsets forces a dispatch once the coalesced apply/revert
+	// set grows past this many tipsets, bounding how much state coalesce
+	// can accumulate between dispatches.
+	MaxPendingTipsets int
+	// EventBufferSize sizes the buffered event queue. Once full, the oldest
+	// queued event is dropped to make room for the newest one, so a slow
+	// notifee applies backpressure to the coalescer's own memory rather
+	// than blocking the chain store's head-change callers.
+	EventBufferSize int
+	// Name labels this instance's metrics so it can be told apart from
+	// other HeadChangeCoalescers (e.g. other MultiNotifee subscribers).
+	// Defaults to "unnamed" when empty.
+	Name string
+}
+
+func (cfg CoalescerConfig) withDefaults() CoalescerConfig {
+	if cfg.MinDelay <= 0 {
+		cfg.MinDelay = time.Second
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = 15 * time.Second
+	}
+	if cfg.MaxPendingTipsets <= 0 {
+		cfg.MaxPendingTipsets = 100
+	}
+	if cfg.EventBufferSize <= 0 {
+		cfg.EventBufferSize = 32
+	}
+	if cfg.Name == "" {
+		cfg.Name = "unnamed"
+	}
+	return cfg
+}
+
+// WrapHeadChangeCoalescer wraps a ReorgNotifee with a head change coalescer,
+// using delay as both the minimum and maximum coalescing delay. Use
+// NewHeadChangeCoalescer directly for finer-grained control.
 func WrapHeadChangeCoalescer(fn ReorgNotifee, delay time.Duration) ReorgNotifee {
-	c := NewHeadChangeCoalescer(fn, delay)
+	c := NewHeadChangeCoalescer(fn, CoalescerConfig{MinDelay: delay, MaxDelay: delay})
 	return c.HeadChange
 }
 
@@ -17,10 +114,15 @@ func WrapHeadChangeCoalescer(fn ReorgNotifee, delay time.Duration) ReorgNotifee
 // with pending head changes to reduce state computations from head change notifications.
 type HeadChangeCoalescer struct {
 	notify ReorgNotifee
+	cfg    CoalescerConfig
 
 	ctx    context.Context
 	cancel func()
 
+	// metricsCtx carries CoalescerNameKey = cfg.Name, computed once so every
+	// stats.Record call doesn't have to re-derive it.
+	metricsCtx context.Context
+
 	eventq chan headChange
 
 	revert []*types.TipSet
@@ -31,29 +133,56 @@ type headChange struct {
 	revert, apply []*types.TipSet
 }
 
-// NewHeadChangeCoalescer creates a HeadChangeCoalescer.
-func NewHeadChangeCoalescer(fn ReorgNotifee, delay time.Duration) *HeadChangeCoalescer {
+// NewHeadChangeCoalescer creates a HeadChangeCoalescer governed by cfg.
+func NewHeadChangeCoalescer(fn ReorgNotifee, cfg CoalescerConfig) *HeadChangeCoalescer {
+	cfg = cfg.withDefaults()
+
+	metricsCtx, err := tag.New(context.Background(), tag.Upsert(CoalescerNameKey, cfg.Name))
+	if err != nil {
+		// tag.New fails only for an invalid tag value (a cfg.Name that is
+		// not printable ASCII or is too long); fall back to an untagged
+		// context rather than propagating an error from the constructor.
+		metricsCtx = context.Background()
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	c := &HeadChangeCoalescer{
-		notify: fn,
-		ctx:    ctx,
-		cancel: cancel,
-		eventq: make(chan headChange),
+		notify:     fn,
+		cfg:        cfg,
+		ctx:        ctx,
+		cancel:     cancel,
+		metricsCtx: metricsCtx,
+		eventq:     make(chan headChange, cfg.EventBufferSize),
 	}
 
-	go c.background(delay)
+	go c.background()
 
 	return c
 }
 
 // HeadChange is the ReorgNotifee callback for the stateful coalescer; it receives an incoming
-// head change and schedules dispatch of a coalesced head change in the background.
+// head change and schedules dispatch of a coalesced head change in the background. If the event
+// buffer is full, the oldest pending event is dropped to make room.
 func (c *HeadChangeCoalescer) HeadChange(revert, apply []*types.TipSet) error {
-	select {
-	case c.eventq <- headChange{revert: revert, apply: apply}:
-		return nil
-	case <-c.ctx.Done():
-		return c.ctx.Err()
+	evt := headChange{revert: revert, apply: apply}
+	for {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+
+		select {
+		case c.eventq <- evt:
+			return nil
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		default:
+		}
+
+		select {
+		case <-c.eventq:
+			stats.Record(c.metricsCtx, DroppedEventsTotal.M(1))
+		default:
+		}
 	}
 }
 
@@ -71,19 +200,33 @@ func (c *HeadChangeCoalescer) Close() error {
 
 // Implementation details
 
-func (c *HeadChangeCoalescer) background(delay time.Duration) {
-	var timerC <-chan time.Time
+func (c *HeadChangeCoalescer) background() {
+	var minTimer, maxTimer <-chan time.Time
 	for {
 		select {
 		case evt := <-c.eventq:
 			c.coalesce(evt.revert, evt.apply)
-			if timerC == nil {
-				timerC = time.After(delay)
+			stats.Record(c.metricsCtx, CoalescedTotal.M(1))
+
+			minTimer = time.After(c.cfg.MinDelay)
+			if maxTimer == nil {
+				maxTimer = time.After(c.cfg.MaxDelay)
 			}
 
-		case <-timerC:
+			if len(c.revert)+len(c.apply) > c.cfg.MaxPendingTipsets {
+				stats.Record(c.metricsCtx, ForcedDispatchTotal.M(1))
+				c.dispatch()
+				minTimer, maxTimer = nil, nil
+			}
+
+		case <-minTimer:
+			c.dispatch()
+			minTimer, maxTimer = nil, nil
+
+		case <-maxTimer:
+			stats.Record(c.metricsCtx, ForcedDispatchTotal.M(1))
 			c.dispatch()
-			timerC = nil
+			minTimer, maxTimer = nil, nil
 
 		case <-c.ctx.Done():
 			if c.revert != nil || c.apply != nil {
@@ -170,7 +313,9 @@ func (c *HeadChangeCoalescer) coalesce(revert, apply []*types.TipSet) {
 }
 
 func (c *HeadChangeCoalescer) dispatch() {
+	start := time.Now()
 	err := c.notify(c.revert, c.apply)
+	stats.Record(c.metricsCtx, DispatchLatency.M(time.Since(start).Seconds()))
 	if err != nil {
 		log.Errorf("error dispatching coalesced head change notification: %s", err)
 	}
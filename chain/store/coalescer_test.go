@@ -0,0 +1,146 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// dispatchRecorder collects the revert/apply sets a ReorgNotifee was called
+// with, safe for concurrent use by the coalescer's background goroutine.
+type dispatchRecorder struct {
+	mu    sync.Mutex
+	calls [][2]int // len(revert), len(apply) per call
+}
+
+func (r *dispatchRecorder) notify(revert, apply []*types.TipSet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, [2]int{len(revert), len(apply)})
+	return nil
+}
+
+func (r *dispatchRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.calls)
+}
+
+func waitForCount(t *testing.T, r *dispatchRecorder, n int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if r.count() >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.GreaterOrEqual(t, r.count(), n, "timed out waiting for dispatch")
+}
+
+func TestHeadChangeCoalescerMinDelay(t *testing.T) {
+	rec := &dispatchRecorder{}
+	c := NewHeadChangeCoalescer(rec.notify, CoalescerConfig{
+		MinDelay: 20 * time.Millisecond,
+		MaxDelay: time.Second,
+	})
+	defer func() { _ = c.Close() }()
+
+	require.NoError(t, c.HeadChange(nil, []*types.TipSet{mock.TipSet(mock.MkBlock(nil, 1, 1))}))
+
+	waitForCount(t, rec, 1, time.Second)
+}
+
+func TestHeadChangeCoalescerMaxDelayBoundsSustainedLoad(t *testing.T) {
+	rec := &dispatchRecorder{}
+	c := NewHeadChangeCoalescer(rec.notify, CoalescerConfig{
+		MinDelay: 50 * time.Millisecond,
+		MaxDelay: 100 * time.Millisecond,
+	})
+	defer func() { _ = c.Close() }()
+
+	// Keep the MinDelay timer resetting by sending events faster than it can
+	// elapse; MaxDelay must still force a dispatch.
+	stop := time.After(300 * time.Millisecond)
+loop:
+	for {
+		select {
+		case <-stop:
+			break loop
+		default:
+			require.NoError(t, c.HeadChange(nil, []*types.TipSet{mock.TipSet(mock.MkBlock(nil, 1, 1))}))
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	require.GreaterOrEqual(t, rec.count(), 1)
+}
+
+func TestHeadChangeCoalescerMaxPendingTipsetsForcesDispatch(t *testing.T) {
+	rec := &dispatchRecorder{}
+	c := NewHeadChangeCoalescer(rec.notify, CoalescerConfig{
+		MinDelay:          time.Minute,
+		MaxDelay:          time.Minute,
+		MaxPendingTipsets: 3,
+	})
+	defer func() { _ = c.Close() }()
+
+	// one more tipset than MaxPendingTipsets, so the pending set grows past it.
+	for i := 0; i < 4; i++ {
+		require.NoError(t, c.HeadChange(nil, []*types.TipSet{mock.TipSet(mock.MkBlock(nil, uint64(i+1), 1))}))
+	}
+
+	waitForCount(t, rec, 1, time.Second)
+}
+
+func TestHeadChangeCoalescerDropsOldestWhenBufferFull(t *testing.T) {
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	var calls int
+
+	c := NewHeadChangeCoalescer(func(revert, apply []*types.TipSet) error {
+		calls++
+		if calls == 1 {
+			close(blocked)
+		}
+		<-unblock
+		return nil
+	}, CoalescerConfig{
+		MinDelay:        time.Millisecond,
+		MaxDelay:        time.Millisecond,
+		EventBufferSize: 1,
+	})
+	defer func() { _ = c.Close() }()
+
+	// First event triggers a dispatch that blocks in notify, tying up the
+	// background goroutine so subsequent events pile up in eventq.
+	require.NoError(t, c.HeadChange(nil, []*types.TipSet{mock.TipSet(mock.MkBlock(nil, 1, 1))}))
+	<-blocked
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, c.HeadChange(nil, []*types.TipSet{mock.TipSet(mock.MkBlock(nil, uint64(i+2), 1))}))
+	}
+
+	close(unblock)
+}
+
+func TestCoalesceCancelsOppositeChanges(t *testing.T) {
+	c := &HeadChangeCoalescer{}
+
+	a := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	b := mock.TipSet(mock.MkBlock(nil, 2, 1))
+
+	c.coalesce([]*types.TipSet{a}, []*types.TipSet{b})
+	require.Equal(t, []*types.TipSet{a}, c.revert)
+	require.Equal(t, []*types.TipSet{b}, c.apply)
+
+	// a revert of b cancels out the pending apply of b.
+	c.coalesce([]*types.TipSet{b}, nil)
+	require.Empty(t, c.apply)
+	require.Equal(t, []*types.TipSet{a}, c.revert)
+}
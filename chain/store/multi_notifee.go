@@ -0,0 +1,264 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// SubscriberOption configures a single subscriber registered with a
+// MultiNotifee via Register.
+type SubscriberOption func(*subscriberConfig)
+
+type subscriberConfig struct {
+	coalescer         CoalescerConfig
+	failureThreshold  int
+	quarantineBackoff time.Duration
+	catchUp           func(ctx context.Context) error
+}
+
+func defaultSubscriberConfig() subscriberConfig {
+	return subscriberConfig{
+		coalescer:         CoalescerConfig{},
+		failureThreshold:  5,
+		quarantineBackoff: time.Minute,
+	}
+}
+
+// WithCoalescerConfig sets the coalescing behaviour of a subscriber's
+// private HeadChangeCoalescer.
+func WithCoalescerConfig(cfg CoalescerConfig) SubscriberOption {
+	return func(c *subscriberConfig) {
+		c.coalescer = cfg
+	}
+}
+
+// WithFailureThreshold sets how many consecutive dispatch failures a
+// subscriber tolerates before MultiNotifee quarantines it.
+func WithFailureThreshold(n int) SubscriberOption {
+	return func(c *subscriberConfig) {
+		c.failureThreshold = n
+	}
+}
+
+// WithQuarantineBackoff sets how long a quarantined subscriber is skipped
+// before MultiNotifee automatically re-subscribes it.
+func WithQuarantineBackoff(d time.Duration) SubscriberOption {
+	return func(c *subscriberConfig) {
+		c.quarantineBackoff = d
+	}
+}
+
+// WithCatchUp registers a hook run when a quarantined subscriber is about to
+// be reinstated, before any further head changes reach it again.
+//
+// MultiNotifee drops (does not queue) head changes for a quarantined
+// subscriber, because without a checkpoint it has no way to replay what it
+// dropped -- so a subscriber built to never miss a tipset, such as a
+// PersistentReorgSubscriber, would otherwise silently lose exactly the head
+// changes it was registered to never lose. Pass a CatchUp hook that performs
+// that subscriber's own checkpoint-driven replay (e.g.
+// func(ctx) error { return persistentSub.CatchUp(ctx, cr) }) and MultiNotifee
+// will run it before clearing quarantine; if it errors, the subscriber stays
+// quarantined and CatchUp is retried after another backoff.
+//
+// If CatchUp is nil (the default), reinstatement is immediate and any head
+// changes during the quarantine window are permanently lost to this
+// subscriber. Composing a PersistentReorgSubscriber with a MultiNotifee
+// without a WithCatchUp hook is a data-loss bug, not a supported
+// configuration.
+func WithCatchUp(fn func(ctx context.Context) error) SubscriberOption {
+	return func(c *subscriberConfig) {
+		c.catchUp = fn
+	}
+}
+
+// notifeeSubscriber is one subscriber registered with a MultiNotifee: its
+// own coalescer, dispatched independently of every other subscriber, plus
+// the failure-isolation state used to quarantine it.
+type notifeeSubscriber struct {
+	name string
+	cfg  subscriberConfig
+
+	coalescer *HeadChangeCoalescer
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	quarantined         bool
+}
+
+// MultiNotifee fans a single head-change stream out to N independently
+// configured ReorgNotifee subscribers, dispatching to all of them
+// concurrently so that one slow or failing subscriber cannot block the
+// others (the chain store's own dispatch to a single notifee stays
+// synchronous; MultiNotifee is itself registered as one such notifee). Each
+// subscriber has its own queue, its own coalescer with its own delay
+// configuration, and its own failure count: a subscriber that fails
+// repeatedly is quarantined and automatically re-subscribed after a
+// backoff, rather than taking the whole stream down.
+//
+// MultiNotifee itself keeps no checkpoint, so head changes arriving while a
+// subscriber is quarantined are dropped for that subscriber, not queued. A
+// subscriber that must never miss a tipset (e.g. a PersistentReorgSubscriber)
+// needs to be registered with a WithCatchUp hook so MultiNotifee can drive
+// its checkpoint-based replay on reinstatement -- see WithCatchUp.
+type MultiNotifee struct {
+	mu          sync.RWMutex
+	subscribers map[string]*notifeeSubscriber
+}
+
+// NewMultiNotifee creates an empty MultiNotifee.
+func NewMultiNotifee() *MultiNotifee {
+	return &MultiNotifee{
+		subscribers: make(map[string]*notifeeSubscriber),
+	}
+}
+
+// Register adds a new subscriber under name, wrapping fn in its own
+// coalescer per opts, and returns an Unregister func that closes the
+// subscriber's coalescer and removes it. Registering a second subscriber
+// under a name that is already registered is an error.
+func (m *MultiNotifee) Register(name string, fn ReorgNotifee, opts ...SubscriberOption) (func(), error) {
+	cfg := defaultSubscriberConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.coalescer.Name == "" {
+		cfg.coalescer.Name = name
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.subscribers[name]; exists {
+		return nil, xerrors.Errorf("subscriber %q already registered", name)
+	}
+
+	sub := &notifeeSubscriber{name: name, cfg: cfg}
+	sub.coalescer = NewHeadChangeCoalescer(sub.wrappedNotify(fn), cfg.coalescer)
+	m.subscribers[name] = sub
+
+	unregister := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if s, ok := m.subscribers[name]; ok && s == sub {
+			_ = s.coalescer.Close()
+			delete(m.subscribers, name)
+		}
+	}
+
+	return unregister, nil
+}
+
+// HeadChange is the ReorgNotifee entry point for the underlying head-change
+// stream: it fans revert/apply out to every registered, non-quarantined
+// subscriber concurrently via an errgroup worker pool, isolating each
+// subscriber's errors from the others.
+func (m *MultiNotifee) HeadChange(revert, apply []*types.TipSet) error {
+	m.mu.RLock()
+	subs := make([]*notifeeSubscriber, 0, len(m.subscribers))
+	for _, s := range m.subscribers {
+		subs = append(subs, s)
+	}
+	m.mu.RUnlock()
+
+	var g errgroup.Group
+	for _, s := range subs {
+		s := s
+		g.Go(func() error {
+			m.dispatchOne(s, revert, apply)
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// dispatchOne forwards a head change into s's own coalescer, unless s is
+// currently quarantined. Note that HeadChangeCoalescer.HeadChange only
+// enqueues the event and returns before the wrapped notifee actually runs,
+// so its return value says nothing about whether fn succeeded; the failure
+// count that drives quarantine is instead updated by wrappedNotify, which
+// runs inside the coalescer's own background dispatch goroutine.
+func (m *MultiNotifee) dispatchOne(s *notifeeSubscriber, revert, apply []*types.TipSet) {
+	s.mu.Lock()
+	quarantined := s.quarantined
+	s.mu.Unlock()
+	if quarantined {
+		return
+	}
+
+	if err := s.coalescer.HeadChange(revert, apply); err != nil {
+		log.Warnf("subscriber %q head change enqueue failed: %s", s.name, err)
+	}
+}
+
+// wrappedNotify adapts fn into the ReorgNotifee given to s's coalescer: it
+// calls fn and records the result against s's consecutive-failure count,
+// quarantining s once that count reaches its failure threshold.
+func (s *notifeeSubscriber) wrappedNotify(fn ReorgNotifee) ReorgNotifee {
+	return func(revert, apply []*types.TipSet) error {
+		err := fn(revert, apply)
+		s.recordResult(err)
+		return err
+	}
+}
+
+func (s *notifeeSubscriber) recordResult(err error) {
+	s.mu.Lock()
+	if err != nil {
+		s.consecutiveFailures++
+	} else {
+		s.consecutiveFailures = 0
+	}
+	shouldQuarantine := err != nil && !s.quarantined && s.consecutiveFailures >= s.cfg.failureThreshold
+	if shouldQuarantine {
+		s.quarantined = true
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		log.Warnf("subscriber %q notifee dispatch failed: %s", s.name, err)
+	}
+	if shouldQuarantine {
+		s.quarantine()
+	}
+}
+
+// quarantine logs s's quarantine and schedules its automatic reinstatement
+// after cfg.quarantineBackoff. Callers must not hold s.mu.
+func (s *notifeeSubscriber) quarantine() {
+	log.Errorf("subscriber %q quarantined after %d consecutive failures; re-subscribing in %s", s.name, s.cfg.failureThreshold, s.cfg.quarantineBackoff)
+
+	time.AfterFunc(s.cfg.quarantineBackoff, s.reinstate)
+}
+
+// reinstate runs cfg.catchUp (if set) to let the subscriber replay whatever
+// it missed while quarantined, then clears the quarantine. If catchUp
+// errors, the subscriber stays quarantined and reinstate is retried after
+// another backoff, rather than silently clearing quarantine over a replay
+// that never actually happened.
+func (s *notifeeSubscriber) reinstate() {
+	if s.cfg.catchUp != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.quarantineBackoff)
+		err := s.cfg.catchUp(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("subscriber %q catch-up failed, remaining quarantined: %s", s.name, err)
+			time.AfterFunc(s.cfg.quarantineBackoff, s.reinstate)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.quarantined = false
+	s.consecutiveFailures = 0
+	s.mu.Unlock()
+
+	log.Infof("subscriber %q re-subscribed after quarantine backoff", s.name)
+}
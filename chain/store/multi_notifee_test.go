@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.True(t, cond(), "condition not met before timeout")
+}
+
+func (m *MultiNotifee) subscriber(name string) *notifeeSubscriber {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.subscribers[name]
+}
+
+func (s *notifeeSubscriber) isQuarantined() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.quarantined
+}
+
+func TestMultiNotifeeQuarantinesAfterRepeatedAsyncFailures(t *testing.T) {
+	m := NewMultiNotifee()
+
+	var mu sync.Mutex
+	var calls int
+	failingFn := func(revert, apply []*types.TipSet) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return errBoom
+	}
+
+	unregister, err := m.Register("flaky", failingFn,
+		WithFailureThreshold(3),
+		WithQuarantineBackoff(50*time.Millisecond),
+		WithCoalescerConfig(CoalescerConfig{MinDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+	)
+	require.NoError(t, err)
+	defer unregister()
+
+	sub := m.subscriber("flaky")
+	require.NotNil(t, sub)
+
+	ts := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, m.HeadChange(nil, []*types.TipSet{ts}))
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	waitFor(t, time.Second, sub.isQuarantined)
+
+	mu.Lock()
+	callsAtQuarantine := calls
+	mu.Unlock()
+
+	// further head changes should be skipped for the quarantined subscriber.
+	require.NoError(t, m.HeadChange(nil, []*types.TipSet{ts}))
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	require.Equal(t, callsAtQuarantine, calls)
+	mu.Unlock()
+
+	// after the backoff elapses, the subscriber is reinstated.
+	waitFor(t, time.Second, func() bool { return !sub.isQuarantined() })
+}
+
+func TestMultiNotifeeCatchUpGatesReinstatement(t *testing.T) {
+	m := NewMultiNotifee()
+
+	failingFn := func(revert, apply []*types.TipSet) error { return errBoom }
+
+	var mu sync.Mutex
+	var catchUpCalls int
+	failCatchUpOnce := true
+	catchUp := func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		catchUpCalls++
+		if failCatchUpOnce {
+			failCatchUpOnce = false
+			return errBoom
+		}
+		return nil
+	}
+
+	unregister, err := m.Register("flaky", failingFn,
+		WithFailureThreshold(1),
+		WithQuarantineBackoff(10*time.Millisecond),
+		WithCatchUp(catchUp),
+		WithCoalescerConfig(CoalescerConfig{MinDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+	)
+	require.NoError(t, err)
+	defer unregister()
+
+	sub := m.subscriber("flaky")
+	require.NotNil(t, sub)
+
+	ts := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	require.NoError(t, m.HeadChange(nil, []*types.TipSet{ts}))
+	waitFor(t, time.Second, sub.isQuarantined)
+
+	// catchUp fails on its first attempt, so the subscriber must stay
+	// quarantined rather than being reinstated blindly.
+	waitFor(t, time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return catchUpCalls >= 1
+	})
+	require.True(t, sub.isQuarantined())
+
+	// once catchUp succeeds, the subscriber is reinstated.
+	waitFor(t, time.Second, func() bool { return !sub.isQuarantined() })
+
+	mu.Lock()
+	require.GreaterOrEqual(t, catchUpCalls, 2)
+	mu.Unlock()
+}
+
+func TestMultiNotifeeRegisterDuplicateNameErrors(t *testing.T) {
+	m := NewMultiNotifee()
+
+	unregister, err := m.Register("dup", func(revert, apply []*types.TipSet) error { return nil })
+	require.NoError(t, err)
+	defer unregister()
+
+	_, err = m.Register("dup", func(revert, apply []*types.TipSet) error { return nil })
+	require.Error(t, err)
+}
+
+type boomError struct{}
+
+func (boomError) Error() string { return "boom" }
+
+var errBoom = boomError{}
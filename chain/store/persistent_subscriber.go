@@ -0,0 +1,263 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// CheckpointStore persists the last tipset height/key that a
+// PersistentReorgSubscriber has successfully dispatched, so that head
+// changes can be replayed from that point after a crash or restart.
+//
+// Implementations (badger, leveldb, a flat file, ...) are expected to make
+// PutCheckpoint durable before it returns, since the checkpoint is the only
+// record of dispatch progress the subscriber has.
+type CheckpointStore interface {
+	// PutCheckpoint durably records height/tsk as the last successfully
+	// dispatched head change.
+	PutCheckpoint(height abi.ChainEpoch, tsk types.TipSetKey) error
+	// GetCheckpoint returns the last recorded checkpoint. ok is false if no
+	// checkpoint has ever been recorded.
+	GetCheckpoint() (height abi.ChainEpoch, tsk types.TipSetKey, ok bool, err error)
+}
+
+// ChainReader is the subset of ChainStore that a PersistentReorgSubscriber
+// needs in order to replay head changes that happened while it was offline
+// and to subscribe to further live head changes.
+type ChainReader interface {
+	GetHeaviestTipSet() *types.TipSet
+	GetTipsetByHeight(ctx context.Context, h abi.ChainEpoch, ts *types.TipSet, prev bool) (*types.TipSet, error)
+	SubscribeHeadChanges(f ReorgNotifee)
+}
+
+// RetryPolicy controls how a PersistentReorgSubscriber retries a notifee
+// that returns an error, and what happens once retries are exhausted.
+type RetryPolicy struct {
+	// MaxRetries is the number of additional attempts made after an initial
+	// failed dispatch. Zero means the dispatch is attempted exactly once.
+	MaxRetries int
+	// InitialBackoff is the delay before the first retry; each subsequent
+	// retry doubles it, capped at MaxBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the exponential backoff delay between retries.
+	MaxBackoff time.Duration
+	// DeadLetter, if non-nil, is called with a head change that could not be
+	// dispatched after MaxRetries retries, and the last error it produced.
+	// If DeadLetter is nil, the head change is logged and dropped.
+	DeadLetter func(revert, apply []*types.TipSet, err error)
+	// SkipCheckpointOnDeadLetter controls whether the checkpoint advances
+	// past a head change that was dead-lettered after MaxRetries retries.
+	//
+	// If false (the default), the checkpoint advances anyway: a
+	// permanently failing notifee cannot wedge the subscriber forever, but
+	// the dead-lettered tipsets are then gone for good -- they are never
+	// replayed again, which contradicts "survive restarts and crashes
+	// without missing tipsets" for anything but a transient failure.
+	//
+	// If true, dispatch returns the dead-letter error instead of
+	// checkpointing, so HeadChange/Start fails and the caller must decide
+	// whether to retry, alert, or otherwise act before the subscriber
+	// progresses past it. Note the checkpoint tracks a single height/key,
+	// not a ledger of gaps: if the caller lets later head changes through
+	// anyway, the checkpoint will still jump forward past the unresolved
+	// one.
+	SkipCheckpointOnDeadLetter bool
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Minute
+	}
+	return p
+}
+
+// PersistentReorgSubscriber wraps a ReorgNotifee with a durable checkpoint:
+// after every successful dispatch it records the tipset the notifee is now
+// caught up to, and on Start it replays any head changes that happened
+// between that checkpoint and the current chain head before handing off to
+// live, coalesced notifications. This lets long-running consumers (indexers,
+// in particular) survive restarts and crashes without missing or
+// double-processing tipsets -- except for a dead-lettered head change under
+// the default RetryPolicy, which is a deliberate tradeoff: see
+// RetryPolicy.SkipCheckpointOnDeadLetter.
+//
+// Coalescing only applies to the live stream: replay dispatches each missed
+// tipset individually (so a crash mid-replay resumes at the right height),
+// while live head changes are merged by a HeadChangeCoalescer before
+// reaching HeadChange. Either way, checkpoint() records the height/key of
+// the last tipset in whatever apply set it was actually called with, so a
+// coalesced batch of N tipsets still only advances the checkpoint once, to
+// its newest tipset.
+//
+// A PersistentReorgSubscriber can also be composed with a MultiNotifee
+// instead of run standalone via Start: register s.HeadChange directly (not
+// the coalescer Start would build, since MultiNotifee already gives every
+// subscriber its own) and pass store.WithCatchUp(func(ctx) error { return
+// s.CatchUp(ctx, cr) }) so MultiNotifee can drive a checkpoint replay when
+// reinstating this subscriber after quarantine. See MultiNotifee's doc
+// comment for why that hook exists.
+type PersistentReorgSubscriber struct {
+	notify       ReorgNotifee
+	store        CheckpointStore
+	policy       RetryPolicy
+	coalescerCfg CoalescerConfig
+
+	coalescer *HeadChangeCoalescer
+}
+
+// NewPersistentReorgSubscriber creates a PersistentReorgSubscriber that
+// checkpoints progress to store, retries failed dispatches per policy, and
+// coalesces its live (post-replay) notifications per coalescerCfg.
+func NewPersistentReorgSubscriber(fn ReorgNotifee, store CheckpointStore, policy RetryPolicy, coalescerCfg CoalescerConfig) *PersistentReorgSubscriber {
+	return &PersistentReorgSubscriber{
+		notify:       fn,
+		store:        store,
+		policy:       policy.withDefaults(),
+		coalescerCfg: coalescerCfg,
+	}
+}
+
+// Start replays any head changes missed since the last checkpoint by walking
+// cr from the checkpointed tipset to the current heaviest tipset, then
+// subscribes cr's live head changes to a HeadChangeCoalescer that dispatches
+// into the PersistentReorgSubscriber.
+func (s *PersistentReorgSubscriber) Start(ctx context.Context, cr ChainReader) error {
+	if err := s.replay(ctx, cr); err != nil {
+		return xerrors.Errorf("replaying head changes from checkpoint: %w", err)
+	}
+
+	cfg := s.coalescerCfg
+	if cfg.Name == "" {
+		cfg.Name = "persistent-reorg-subscriber"
+	}
+	s.coalescer = NewHeadChangeCoalescer(s.HeadChange, cfg)
+
+	cr.SubscribeHeadChanges(s.coalescer.HeadChange)
+	return nil
+}
+
+// Close stops the live coalescer started by Start. It is a no-op if Start
+// has not been called.
+func (s *PersistentReorgSubscriber) Close() error {
+	if s.coalescer == nil {
+		return nil
+	}
+	return s.coalescer.Close()
+}
+
+// CatchUp replays any head changes missed since the last checkpoint, without
+// starting a live coalescer or subscribing to cr. It is the standalone
+// counterpart of the replay Start performs internally, meant for a
+// PersistentReorgSubscriber that is registered under a MultiNotifee (via
+// WithCatchUp) rather than run through Start -- see the type doc comment.
+func (s *PersistentReorgSubscriber) CatchUp(ctx context.Context, cr ChainReader) error {
+	return s.replay(ctx, cr)
+}
+
+// HeadChange is the ReorgNotifee callback registered for live notifications.
+func (s *PersistentReorgSubscriber) HeadChange(revert, apply []*types.TipSet) error {
+	return s.dispatch(revert, apply)
+}
+
+func (s *PersistentReorgSubscriber) replay(ctx context.Context, cr ChainReader) error {
+	height, tsk, ok, err := s.store.GetCheckpoint()
+	if err != nil {
+		return xerrors.Errorf("loading checkpoint: %w", err)
+	}
+	if !ok {
+		// nothing checkpointed yet; start from live notifications only.
+		return nil
+	}
+
+	head := cr.GetHeaviestTipSet()
+	if head == nil || head.Height() <= height {
+		return nil
+	}
+
+	cur, err := cr.GetTipsetByHeight(ctx, height, head, false)
+	if err != nil {
+		return xerrors.Errorf("resolving checkpointed tipset at height %d: %w", height, err)
+	}
+	if cur.Key() != tsk {
+		log.Warnf("checkpointed tipset %s at height %d not found on current chain (found %s instead); replaying from height %d on the current chain", tsk, height, cur.Key(), height)
+	}
+
+	for h := cur.Height() + 1; h <= head.Height(); h++ {
+		next, err := cr.GetTipsetByHeight(ctx, h, head, false)
+		if err != nil {
+			return xerrors.Errorf("resolving tipset at height %d during replay: %w", h, err)
+		}
+		if next.Height() != h {
+			// null round at this height; nothing to apply.
+			continue
+		}
+		if err := s.dispatch(nil, []*types.TipSet{next}); err != nil {
+			return xerrors.Errorf("replaying head change to height %d: %w", h, err)
+		}
+	}
+
+	return nil
+}
+
+// dispatch invokes the wrapped notifee, retrying with exponential backoff on
+// error. Once dispatched successfully, or once retries are exhausted and the
+// head change is dead-lettered, it checkpoints progress -- unless
+// policy.SkipCheckpointOnDeadLetter is set, in which case a dead-lettered
+// head change returns its error without checkpointing instead.
+func (s *PersistentReorgSubscriber) dispatch(revert, apply []*types.TipSet) error {
+	backoff := s.policy.InitialBackoff
+
+	var err error
+	for attempt := 0; attempt <= s.policy.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > s.policy.MaxBackoff {
+				backoff = s.policy.MaxBackoff
+			}
+		}
+
+		if err = s.notify(revert, apply); err == nil {
+			return s.checkpoint(apply)
+		}
+
+		log.Warnf("reorg notifee dispatch failed (attempt %d/%d): %s", attempt+1, s.policy.MaxRetries+1, err)
+	}
+
+	if s.policy.DeadLetter != nil {
+		s.policy.DeadLetter(revert, apply, err)
+	} else {
+		log.Errorf("reorg notifee dispatch failed after %d attempts, dropping head change: %s", s.policy.MaxRetries+1, err)
+	}
+
+	if s.policy.SkipCheckpointOnDeadLetter {
+		return xerrors.Errorf("dispatch dead-lettered without checkpointing: %w", err)
+	}
+
+	// Advance the checkpoint regardless so a permanently failing notifee
+	// cannot wedge the subscriber on the same head change forever. This is
+	// a deliberate data-loss tradeoff; see RetryPolicy.SkipCheckpointOnDeadLetter.
+	return s.checkpoint(apply)
+}
+
+func (s *PersistentReorgSubscriber) checkpoint(apply []*types.TipSet) error {
+	if len(apply) == 0 {
+		return nil
+	}
+
+	head := apply[len(apply)-1]
+	if err := s.store.PutCheckpoint(head.Height(), head.Key()); err != nil {
+		return xerrors.Errorf("persisting checkpoint at height %d: %w", head.Height(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// fakeCheckpointStore is an in-memory CheckpointStore for tests.
+type fakeCheckpointStore struct {
+	mu     sync.Mutex
+	height abi.ChainEpoch
+	tsk    types.TipSetKey
+	ok     bool
+}
+
+func (f *fakeCheckpointStore) PutCheckpoint(height abi.ChainEpoch, tsk types.TipSetKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.height, f.tsk, f.ok = height, tsk, true
+	return nil
+}
+
+func (f *fakeCheckpointStore) GetCheckpoint() (abi.ChainEpoch, types.TipSetKey, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.height, f.tsk, f.ok, nil
+}
+
+// fakeChainReader serves a linear chain of tipsets, one per height starting
+// at 0, to satisfy ChainReader in tests.
+type fakeChainReader struct {
+	chain []*types.TipSet
+}
+
+func buildChain(n int) []*types.TipSet {
+	chain := make([]*types.TipSet, 0, n)
+	var prev *types.TipSet
+	for i := 0; i < n; i++ {
+		ts := mock.TipSet(mock.MkBlock(prev, 1, 1))
+		chain = append(chain, ts)
+		prev = ts
+	}
+	return chain
+}
+
+func (f *fakeChainReader) GetHeaviestTipSet() *types.TipSet {
+	return f.chain[len(f.chain)-1]
+}
+
+func (f *fakeChainReader) GetTipsetByHeight(_ context.Context, h abi.ChainEpoch, _ *types.TipSet, _ bool) (*types.TipSet, error) {
+	return f.chain[int(h)], nil
+}
+
+func (f *fakeChainReader) SubscribeHeadChanges(fn ReorgNotifee) {}
+
+func TestPersistentReorgSubscriberReplayNoCheckpointIsNoop(t *testing.T) {
+	store := &fakeCheckpointStore{}
+	cr := &fakeChainReader{chain: buildChain(5)}
+
+	var calls int
+	notify := func(revert, apply []*types.TipSet) error {
+		calls++
+		return nil
+	}
+
+	s := NewPersistentReorgSubscriber(notify, store, RetryPolicy{}, CoalescerConfig{})
+	require.NoError(t, s.Start(context.Background(), cr))
+	defer func() { _ = s.Close() }()
+
+	require.Equal(t, 0, calls)
+}
+
+func TestPersistentReorgSubscriberReplayAppliesMissedHeights(t *testing.T) {
+	chain := buildChain(5) // heights 0..4
+	store := &fakeCheckpointStore{}
+	require.NoError(t, store.PutCheckpoint(chain[2].Height(), chain[2].Key()))
+	cr := &fakeChainReader{chain: chain}
+
+	var mu sync.Mutex
+	var applied []abi.ChainEpoch
+	notify := func(revert, apply []*types.TipSet) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ts := range apply {
+			applied = append(applied, ts.Height())
+		}
+		return nil
+	}
+
+	s := NewPersistentReorgSubscriber(notify, store, RetryPolicy{}, CoalescerConfig{})
+	require.NoError(t, s.Start(context.Background(), cr))
+	defer func() { _ = s.Close() }()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []abi.ChainEpoch{3, 4}, applied)
+
+	height, tsk, ok, err := store.GetCheckpoint()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, chain[4].Height(), height)
+	require.Equal(t, chain[4].Key(), tsk)
+}
+
+func TestPersistentReorgSubscriberDispatchRetriesThenDeadLetters(t *testing.T) {
+	store := &fakeCheckpointStore{}
+
+	var attempts int
+	failingNotify := func(revert, apply []*types.TipSet) error {
+		attempts++
+		return context.DeadlineExceeded
+	}
+
+	var deadLettered bool
+	s := NewPersistentReorgSubscriber(failingNotify, store, RetryPolicy{
+		MaxRetries:     2,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		DeadLetter: func(revert, apply []*types.TipSet, err error) {
+			deadLettered = true
+		},
+	}, CoalescerConfig{})
+
+	chain := buildChain(1)
+	err := s.HeadChange(nil, chain)
+	require.NoError(t, err)
+	require.Equal(t, 3, attempts) // 1 initial attempt + 2 retries
+	require.True(t, deadLettered)
+
+	// the checkpoint still advances so a permanently failing notifee cannot
+	// wedge the subscriber on the same head change forever.
+	_, _, ok, err := store.GetCheckpoint()
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestPersistentReorgSubscriberSkipCheckpointOnDeadLetter(t *testing.T) {
+	store := &fakeCheckpointStore{}
+
+	failingNotify := func(revert, apply []*types.TipSet) error {
+		return context.DeadlineExceeded
+	}
+
+	s := NewPersistentReorgSubscriber(failingNotify, store, RetryPolicy{
+		InitialBackoff:             time.Millisecond,
+		MaxBackoff:                 time.Millisecond,
+		SkipCheckpointOnDeadLetter: true,
+	}, CoalescerConfig{})
+
+	chain := buildChain(1)
+	err := s.HeadChange(nil, chain)
+	require.Error(t, err)
+
+	// the checkpoint must not advance past a dead letter that was never
+	// actually processed.
+	_, _, ok, err := store.GetCheckpoint()
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestPersistentReorgSubscriberCatchUp(t *testing.T) {
+	chain := buildChain(3) // heights 0..2
+	store := &fakeCheckpointStore{}
+	require.NoError(t, store.PutCheckpoint(chain[0].Height(), chain[0].Key()))
+	cr := &fakeChainReader{chain: chain}
+
+	var mu sync.Mutex
+	var applied []abi.ChainEpoch
+	notify := func(revert, apply []*types.TipSet) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ts := range apply {
+			applied = append(applied, ts.Height())
+		}
+		return nil
+	}
+
+	s := NewPersistentReorgSubscriber(notify, store, RetryPolicy{}, CoalescerConfig{})
+	// CatchUp replays without starting a live coalescer or subscription,
+	// for use alongside MultiNotifee's WithCatchUp instead of Start.
+	require.NoError(t, s.CatchUp(context.Background(), cr))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []abi.ChainEpoch{1, 2}, applied)
+}